@@ -0,0 +1,120 @@
+// Package previewv1 defines the preview.example.com/v1 Preview CRD: the
+// declarative counterpart to the imperative `preview create` CLI flow.
+package previewv1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const GroupName = "preview.example.com"
+
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
+
+var (
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	AddToScheme   = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion, &Preview{}, &PreviewList{})
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
+
+// Preview is the declarative request for one preview environment: "mirror
+// originService at version, expose it at url through gateway".
+type Preview struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PreviewSpec   `json:"spec"`
+	Status PreviewStatus `json:"status,omitempty"`
+}
+
+type PreviewSpec struct {
+	OriginService string `json:"originService"`
+	Version       string `json:"version"`
+	Gateway       string `json:"gateway"`
+	URL           string `json:"url"`
+
+	// Image and Env override the mirrored Deployment when the preview
+	// needs to run different code/config than the origin Service.
+	Image string          `json:"image,omitempty"`
+	Env   []corev1.EnvVar `json:"env,omitempty"`
+
+	// LegacyServiceClone opts this preview out of DestinationRule subset
+	// routing and back into the old clone-the-whole-Service behavior, for
+	// origin services that can't yet carry a subset label (e.g. an
+	// external DestinationRule already owns their subsets).
+	LegacyServiceClone bool `json:"legacyServiceClone,omitempty"`
+
+	// Propagation controls how an EnvoyFilter on the preview's pods handles
+	// X-PREVIEW: "off" (default) installs nothing; "lua" stashes the
+	// header into dynamic metadata on inbound requests for observability
+	// only (it cannot re-inject it on outbound calls — Lua has no state
+	// that crosses listener chains); "wasm" additionally re-injects the
+	// header on the pod's own outbound calls via shared proxy-wasm state,
+	// so it's the only mode that keeps X-PREVIEW alive past the first hop.
+	Propagation string `json:"propagation,omitempty"`
+}
+
+type PreviewConditionType string
+
+const (
+	PreviewConditionReady PreviewConditionType = "Ready"
+)
+
+type PreviewCondition struct {
+	Type               PreviewConditionType  `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// PreviewStatus records the names of the Service, Deployment and gateway
+// VirtualService serving this Preview (in subset mode the Service is the
+// origin's own). Update and delete derive those names from the Spec and do
+// not read them back from here.
+type PreviewStatus struct {
+	ServiceName        string             `json:"serviceName,omitempty"`
+	DeploymentName     string             `json:"deploymentName,omitempty"`
+	VirtualServiceName string             `json:"virtualServiceName,omitempty"`
+	Conditions         []PreviewCondition `json:"conditions,omitempty"`
+}
+
+type PreviewList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Preview `json:"items"`
+}
+
+func (p *Preview) DeepCopyObject() runtime.Object {
+	if p == nil {
+		return nil
+	}
+	out := new(Preview)
+	*out = *p
+	out.ObjectMeta = *p.ObjectMeta.DeepCopy()
+	out.Spec.Env = append([]corev1.EnvVar(nil), p.Spec.Env...)
+	out.Status.Conditions = append([]PreviewCondition(nil), p.Status.Conditions...)
+	return out
+}
+
+func (pl *PreviewList) DeepCopyObject() runtime.Object {
+	if pl == nil {
+		return nil
+	}
+	out := new(PreviewList)
+	out.TypeMeta = pl.TypeMeta
+	out.ListMeta = pl.ListMeta
+	out.Items = make([]Preview, len(pl.Items))
+	for i := range pl.Items {
+		out.Items[i] = *pl.Items[i].DeepCopyObject().(*Preview)
+	}
+	return out
+}
@@ -0,0 +1,347 @@
+// Command preview-controller watches Preview custom resources and drives
+// the same create/update/delete logic the `preview` CLI used to run
+// inline, so a Preview object is the source of truth instead of a one-shot
+// CLI invocation.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	previewv1 "github.com/center-place/techbookfest-10-support/create-preview-sample/apis/previewv1"
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/cluster"
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/k8sutil"
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/preview"
+)
+
+const defaultClusterRegistryNamespace = "preview-system"
+
+// previewFinalizer blocks a Preview from actually being removed until
+// reconcileDelete has torn down everything it owns. Without it the object
+// (and its Spec) is gone by the time the informer notices the delete, so
+// there's nothing left to tear down by other than re-deriving
+// originService/version from the bare name — which breaks for any version
+// containing a hyphen. Holding the object open via the finalizer keeps the
+// full Spec available for the whole teardown.
+const previewFinalizer = "preview.example.com/finalizer"
+
+var previewGVR = previewv1.SchemeGroupVersion.WithResource("previews")
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetOutput(os.Stdout)
+}
+
+func main() {
+	dc, err := k8sutil.NewDynamicClient()
+	if err != nil {
+		log.Fatalf("failed to build dynamic client: %v", err)
+	}
+	cs, err := k8sutil.NewK8sClient()
+	if err != nil {
+		log.Fatalf("failed to build k8s client: %v", err)
+	}
+	ics, err := k8sutil.NewIstioClient()
+	if err != nil {
+		log.Fatalf("failed to build istio client: %v", err)
+	}
+
+	c := &controller{
+		dc:    dc,
+		cs:    cs,
+		ics:   ics,
+		queue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dc, 30*time.Second, preview.AppNamespace, nil)
+	informer := factory.ForResource(previewGVR).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueue(obj) },
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+
+	clusterRegistryNs := os.Getenv("CLUSTER_REGISTRY_NAMESPACE")
+	if clusterRegistryNs == "" {
+		clusterRegistryNs = defaultClusterRegistryNamespace
+	}
+	registry := cluster.NewRegistry()
+	cluster.Watch(cs, clusterRegistryNs, registry, func(rc *cluster.RemoteController) {
+		if err := backfillCluster(context.Background(), dc, rc); err != nil {
+			log.Printf("failed to backfill newly registered cluster %s: %v", rc.Name, err)
+		}
+	}, stop)
+
+	c.run(stop)
+}
+
+// backfillCluster replicates every Preview this controller already knows
+// about into a cluster that just joined the registry, so onboarding a
+// cluster doesn't require recreating every in-flight preview by hand.
+func backfillCluster(ctx context.Context, localDC dynamic.Interface, rc *cluster.RemoteController) error {
+	list, err := localDC.Resource(previewGVR).Namespace(preview.AppNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	remote := rc.DynamicClient.Resource(previewGVR).Namespace(preview.AppNamespace)
+	for i := range list.Items {
+		item := list.Items[i]
+		// Server-set metadata from this cluster would fail the apply on the
+		// remote one (managedFields must be nil; resourceVersion and uid
+		// act as preconditions there).
+		item.SetResourceVersion("")
+		item.SetUID("")
+		item.SetManagedFields(nil)
+		if _, err := remote.Apply(ctx, item.GetName(), &item, metav1.ApplyOptions{FieldManager: "preview"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type controller struct {
+	dc    dynamic.Interface
+	cs    *kubernetes.Clientset
+	ics   *versionedclient.Clientset
+	queue workqueue.RateLimitingInterface
+}
+
+func (c *controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *controller) run(stop <-chan struct{}) {
+	defer c.queue.ShutDown()
+	go c.runWorker()
+	<-stop
+}
+
+func (c *controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *controller) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(context.Background(), key.(string)); err != nil {
+		log.Printf("failed to reconcile %s: %v, requeuing", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *controller) reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.dc.Resource(previewGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// previewFinalizer holds the object open until reconcileDelete
+			// has already run and dropped it below, so by the time it's
+			// actually gone there's nothing left to do.
+			return nil
+		}
+		return err
+	}
+
+	p := &previewv1.Preview{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, p); err != nil {
+		return err
+	}
+
+	if p.DeletionTimestamp != nil {
+		if err := c.reconcileDelete(ctx, p); err != nil {
+			return err
+		}
+		return c.removeFinalizer(ctx, u)
+	}
+
+	if !hasFinalizer(u, previewFinalizer) {
+		if err := c.addFinalizer(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	return c.reconcileCreateOrUpdate(ctx, p)
+}
+
+func hasFinalizer(u *unstructured.Unstructured, name string) bool {
+	for _, f := range u.GetFinalizers() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *controller) addFinalizer(ctx context.Context, u *unstructured.Unstructured) error {
+	u.SetFinalizers(append(u.GetFinalizers(), previewFinalizer))
+	_, err := c.dc.Resource(previewGVR).Namespace(u.GetNamespace()).Update(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+func (c *controller) removeFinalizer(ctx context.Context, u *unstructured.Unstructured) error {
+	finalizers := u.GetFinalizers()
+	kept := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		if f != previewFinalizer {
+			kept = append(kept, f)
+		}
+	}
+	u.SetFinalizers(kept)
+	_, err := c.dc.Resource(previewGVR).Namespace(u.GetNamespace()).Update(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// reconcileCreateOrUpdate ensures every object a Preview owns exists and is
+// up to date. Each Create* it calls is idempotent (a no-op if its object
+// already exists), so every step runs on every reconcile instead of being
+// skipped wholesale once the mirrored Deployment is there — a step that
+// failed on a previous pass (e.g. a webhook rejecting CreateEnvoyFilter)
+// gets retried here rather than silently staying half-provisioned forever.
+func (c *controller) reconcileCreateOrUpdate(ctx context.Context, p *previewv1.Preview) error {
+	owner := ownerRef(p)
+	legacy := p.Spec.LegacyServiceClone
+
+	var selector *preview.Selector
+	var err error
+	if legacy {
+		selector, err = preview.CreateService(ctx, c.cs, p.Spec.OriginService, p.Spec.Version, owner)
+		if err != nil {
+			return err
+		}
+		if err := preview.CreateDeploy(ctx, c.cs, selector, p.Spec.Version, p.Spec.Image, p.Spec.Env, owner); err != nil {
+			return err
+		}
+	} else {
+		if err := preview.EnsureOriginPrimaryLabel(ctx, c.cs, p.Spec.OriginService); err != nil {
+			return err
+		}
+		if err := preview.CreateMirrorDeploy(ctx, c.cs, p.Spec.OriginService, p.Spec.Version, p.Spec.Image, p.Spec.Env, owner); err != nil {
+			return err
+		}
+		if err := preview.ReconcileDestinationRule(ctx, c.ics, p.Spec.OriginService, p.Spec.Version); err != nil {
+			return err
+		}
+	}
+	// Re-apply the image/env overrides regardless of whether the mirrored
+	// Deployment was just created above or already existed from a prior
+	// reconcile, so editing a Preview's spec actually mutates it.
+	if err := preview.UpdateDeploy(ctx, c.cs, p.Spec.OriginService, p.Spec.Version, p.Spec.Image, p.Spec.Env); err != nil {
+		return err
+	}
+
+	if err := preview.CreateSidecarVirtualService(ctx, c.ics, p.Spec.OriginService, p.Spec.Version, legacy); err != nil {
+		return err
+	}
+	if err := preview.CreateGatewayVirtualService(ctx, c.ics, p.Spec.URL, p.Spec.Gateway, p.Spec.OriginService, p.Spec.Version, legacy, owner); err != nil {
+		return err
+	}
+	if err := preview.CreateEnvoyFilter(ctx, c.ics, p.Spec.OriginService, p.Spec.Version, p.Spec.Propagation, workloadLabels(selector, p.Spec.Version, legacy), owner); err != nil {
+		return err
+	}
+	return c.updateStatus(ctx, p, legacy)
+}
+
+// updateStatus records the names of the objects this reconcile pass
+// ensured exist and marks the Preview Ready, via the status subresource so
+// it never clobbers a concurrent Spec edit.
+func (c *controller) updateStatus(ctx context.Context, p *previewv1.Preview, legacy bool) error {
+	deployName := preview.PreviewName(p.Spec.OriginService, p.Spec.Version)
+	p.Status.DeploymentName = deployName
+	if legacy {
+		p.Status.ServiceName = deployName
+	} else {
+		p.Status.ServiceName = p.Spec.OriginService
+	}
+	p.Status.VirtualServiceName = preview.PreviewGatewayVirtualServiceName(p.Spec.OriginService, p.Spec.Version)
+	p.Status.Conditions = []previewv1.PreviewCondition{{
+		Type:               previewv1.PreviewConditionReady,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Reason:             "Reconciled",
+	}}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.dc.Resource(previewGVR).Namespace(p.Namespace).UpdateStatus(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
+
+// workloadLabels returns the label set that actually lands on the preview's
+// pods, so the EnvoyFilter's workloadSelector matches whichever Deployment
+// labeling scheme produced them: CreateDeploy's selector-derived label in
+// legacy mode, CreateMirrorDeploy's subset label otherwise.
+func workloadLabels(selector *preview.Selector, version string, legacy bool) map[string]string {
+	if legacy {
+		return map[string]string{selector.Key: preview.PreviewName(selector.Value, version)}
+	}
+	return map[string]string{preview.SubsetLabelKey: preview.SubsetName(version)}
+}
+
+// reconcileDelete tears down everything a Preview owns, reading
+// originService/version straight off its Spec rather than re-deriving them
+// from the object's name — the finalizer in reconcile keeps the Spec
+// available for exactly this.
+func (c *controller) reconcileDelete(ctx context.Context, p *previewv1.Preview) error {
+	originSvcName, version := p.Spec.OriginService, p.Spec.Version
+	if err := preview.DeleteServiceAndDeploy(ctx, c.cs, originSvcName, version); err != nil {
+		return err
+	}
+	if err := preview.DeleteDestinationRuleSubset(ctx, c.ics, originSvcName, version); err != nil {
+		return err
+	}
+	if err := preview.DeleteGatewayVirtualService(ctx, c.ics, originSvcName, version); err != nil {
+		return err
+	}
+	if err := preview.DeleteSidecarVirtualServiceRoute(ctx, c.ics, originSvcName, version); err != nil {
+		return err
+	}
+	return preview.DeleteEnvoyFilter(ctx, c.ics, originSvcName, version)
+}
+
+func ownerRef(p *previewv1.Preview) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: previewv1.SchemeGroupVersion.String(),
+		Kind:       "Preview",
+		Name:       p.Name,
+		UID:        p.UID,
+		Controller: &controller,
+	}
+}
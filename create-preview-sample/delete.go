@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/cluster"
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/preview"
+)
+
+type cmdDelete struct {
+	originService     string
+	previewVersion    string
+	dryRun            bool
+	clusters          string
+	clusterRegistryNs string
+}
+
+func (c *cmdDelete) New() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "delete preview resources",
+		RunE:  c.RunE,
+	}
+
+	cmd.Flags().StringVarP(&c.previewVersion, "version", "v", "", "preview version (e.g. pull-request ID)")
+	cmd.MarkFlagRequired("version")
+	cmd.Flags().StringVarP(&c.originService, "service", "s", "", "preview original service name")
+	cmd.MarkFlagRequired("service")
+	cmd.Flags().BoolVar(&c.dryRun, "dry-run", false, "print the objects that would be changed/deleted as YAML instead of applying")
+	cmd.Flags().StringVar(&c.clusters, "clusters", cluster.AllClusters, "comma-separated cluster names to tear down the preview in, or \"all\"")
+	cmd.Flags().StringVar(&c.clusterRegistryNs, "cluster-registry-namespace", "preview-system", "namespace holding the preview/cluster=true kubeconfig Secrets")
+
+	return cmd
+}
+
+// RunE just deletes the Preview object per target cluster and leaves that
+// cluster's controller to drive the actual teardown (mirrored
+// Service/Deployment, DestinationRule subset, gateway/sidecar
+// VirtualServices, EnvoyFilter) through the same reconcile path `preview
+// create` uses — see controller/main.go's reconcileDelete. --dry-run is
+// the one path that reads Istio objects (the sidecar VirtualService and
+// DestinationRule) directly, since it has to read current state to show
+// what would change; the other objects are only listed by name.
+func (c *cmdDelete) RunE(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	targets, err := loadClusterTargets(ctx, c.clusterRegistryNs, c.clusters)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if c.dryRun {
+			if err := c.printPlan(ctx, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.apply(ctx, target); err != nil {
+			return fmt.Errorf("%s: %w", target.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *cmdDelete) apply(ctx context.Context, rc *cluster.RemoteController) error {
+	name := preview.PreviewName(c.originService, c.previewVersion)
+	err := rc.DynamicClient.Resource(previewGVR).Namespace(preview.AppNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *cmdDelete) printPlan(ctx context.Context, rc *cluster.RemoteController) error {
+	fmt.Printf("---\n# cluster: %s\n", rc.Name)
+
+	vs, vsEmpty, vsExists, err := preview.PlanSidecarVirtualServiceWithoutRoute(ctx, rc.IstioClient, c.originService, c.previewVersion)
+	if err != nil {
+		return err
+	}
+	if vsExists {
+		if vsEmpty {
+			fmt.Printf("# would delete VirtualService %s\n", vs.Name)
+		} else if err := printYAML(vs); err != nil {
+			return err
+		}
+	}
+
+	dr, drEmpty, drExists, err := preview.PlanDestinationRuleWithoutSubset(ctx, rc.IstioClient, c.originService, c.previewVersion)
+	if err != nil {
+		return err
+	}
+	if drExists {
+		if drEmpty {
+			fmt.Printf("# would delete DestinationRule %s\n", dr.Name)
+		} else if err := printYAML(dr); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("# would delete Service/Deployment %s\n", preview.PreviewName(c.originService, c.previewVersion))
+	fmt.Printf("# would delete VirtualService %s\n", preview.PreviewGatewayVirtualServiceName(c.originService, c.previewVersion))
+	fmt.Printf("# would delete EnvoyFilter %s-envoy-filter\n", preview.PreviewName(c.originService, c.previewVersion))
+	fmt.Printf("# would delete Preview %s\n", preview.PreviewName(c.originService, c.previewVersion))
+	return nil
+}
+
+func printYAML(obj interface{}) error {
+	out, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
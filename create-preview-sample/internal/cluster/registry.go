@@ -0,0 +1,220 @@
+// Package cluster builds per-cluster Kubernetes/Istio clients from a
+// registry of kubeconfig Secrets, the same pattern Admiral's
+// secretcontroller uses: every Secret labeled preview/cluster=true in a
+// configured namespace carries one kubeconfig per data key, keyed by the
+// cluster name it points at.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/center-place/techbookfest-10-support/create-preview-sample/internal/k8sutil"
+)
+
+const ClusterSecretLabelSelector = "preview/cluster=true"
+
+// RemoteController holds the clients for one registered cluster.
+type RemoteController struct {
+	Name          string
+	K8sClient     *kubernetes.Clientset
+	IstioClient   *versionedclient.Clientset
+	DynamicClient dynamic.Interface
+}
+
+func newRemoteController(name string, kubeconfig []byte) (*RemoteController, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig for cluster %s: %w", name, err)
+	}
+	k8sClient, err := k8sutil.NewK8sClientFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	istioClient, err := k8sutil.NewIstioClientFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := k8sutil.NewDynamicClientFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteController{
+		Name:          name,
+		K8sClient:     k8sClient,
+		IstioClient:   istioClient,
+		DynamicClient: dynamicClient,
+	}, nil
+}
+
+// Registry is the live set of RemoteControllers, keyed by cluster name.
+type Registry struct {
+	mu       sync.RWMutex
+	clusters map[string]*RemoteController
+}
+
+func NewRegistry() *Registry {
+	return &Registry{clusters: map[string]*RemoteController{}}
+}
+
+func (r *Registry) Get(name string) (*RemoteController, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rc, ok := r.clusters[name]
+	return rc, ok
+}
+
+func (r *Registry) All() map[string]*RemoteController {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]*RemoteController, len(r.clusters))
+	for k, v := range r.clusters {
+		out[k] = v
+	}
+	return out
+}
+
+func (r *Registry) set(name string, rc *RemoteController) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clusters[name] = rc
+}
+
+func (r *Registry) delete(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clusters, name)
+}
+
+// AllClusters is the --clusters value meaning "every registered cluster".
+const AllClusters = "all"
+
+// Resolve turns a --clusters flag value ("all" or a comma-separated list)
+// into the matching RemoteControllers, shared by `preview create` and
+// `preview delete` so both fan out to the same clusters the same way.
+func Resolve(registry *Registry, selector string) ([]*RemoteController, error) {
+	all := registry.All()
+	if selector == AllClusters {
+		targets := make([]*RemoteController, 0, len(all))
+		for _, rc := range all {
+			targets = append(targets, rc)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no clusters registered")
+		}
+		return targets, nil
+	}
+
+	var targets []*RemoteController
+	for _, name := range strings.Split(selector, ",") {
+		name = strings.TrimSpace(name)
+		rc, ok := all[name]
+		if !ok {
+			return nil, fmt.Errorf("cluster %q not found in registry", name)
+		}
+		targets = append(targets, rc)
+	}
+	return targets, nil
+}
+
+// Load does a one-shot list of the cluster-registry Secrets, for callers
+// like the CLI that don't stay running long enough to need a watch.
+func Load(ctx context.Context, cs *kubernetes.Clientset, namespace string) (*Registry, error) {
+	registry := NewRegistry()
+	secrets, err := cs.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{LabelSelector: ClusterSecretLabelSelector})
+	if err != nil {
+		return nil, err
+	}
+	for i := range secrets.Items {
+		if err := registry.addSecret(&secrets.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+func (r *Registry) addSecret(secret *corev1.Secret) error {
+	for name, kubeconfig := range secret.Data {
+		rc, err := newRemoteController(name, kubeconfig)
+		if err != nil {
+			return err
+		}
+		r.set(name, rc)
+	}
+	return nil
+}
+
+func (r *Registry) removeSecret(secret *corev1.Secret) {
+	for name := range secret.Data {
+		r.delete(name)
+	}
+}
+
+// Watch keeps the Registry in sync with the cluster-registry Secrets for
+// the lifetime of stop, calling onAdd whenever a cluster is newly
+// registered so the caller (the preview controller) can backfill it with
+// the Previews that already exist.
+func Watch(cs *kubernetes.Clientset, namespace string, registry *Registry, onAdd func(rc *RemoteController), stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 30*time.Second,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = ClusterSecretLabelSelector
+		}),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			secret, ok := obj.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			if err := registry.addSecret(secret); err != nil {
+				return
+			}
+			for name := range secret.Data {
+				if rc, ok := registry.Get(name); ok {
+					onAdd(rc)
+				}
+			}
+		},
+		UpdateFunc: func(oldObj, obj interface{}) {
+			secret, ok := obj.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			if err := registry.addSecret(secret); err != nil {
+				return
+			}
+			old, _ := oldObj.(*corev1.Secret)
+			for name := range secret.Data {
+				if old != nil {
+					if _, had := old.Data[name]; had {
+						continue
+					}
+				}
+				if rc, ok := registry.Get(name); ok {
+					onAdd(rc)
+				}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				registry.removeSecret(secret)
+			}
+		},
+	})
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+}
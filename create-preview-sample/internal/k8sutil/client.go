@@ -0,0 +1,71 @@
+// Package k8sutil builds the Kubernetes and Istio clients shared by the
+// preview CLI and the preview controller.
+package k8sutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+
+	// kubeconfig auth via gcloud
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+)
+
+const runInCluster = "RUN_IN_CLUSTER"
+
+func GetRestConfig() (*rest.Config, error) {
+	if os.Getenv(runInCluster) != "" {
+		return rest.InClusterConfig()
+	}
+	kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+func NewK8sClient() (*kubernetes.Clientset, error) {
+	config, err := GetRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewK8sClientFromConfig(config)
+}
+
+func NewIstioClient() (*versionedclient.Clientset, error) {
+	config, err := GetRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewIstioClientFromConfig(config)
+}
+
+// NewDynamicClient is used for the Preview CRD itself, which has no
+// hand-written clientset: callers build unstructured.Unstructured objects
+// and talk to the apiserver via the preview.example.com/v1 GVR.
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := GetRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewDynamicClientFromConfig(config)
+}
+
+// The FromConfig variants below take an explicit *rest.Config instead of
+// resolving one from the environment, so a caller juggling several
+// clusters (see internal/cluster) can build a client per remote kubeconfig.
+
+func NewK8sClientFromConfig(config *rest.Config) (*kubernetes.Clientset, error) {
+	return kubernetes.NewForConfig(config)
+}
+
+func NewIstioClientFromConfig(config *rest.Config) (*versionedclient.Clientset, error) {
+	return versionedclient.NewForConfig(config)
+}
+
+func NewDynamicClientFromConfig(config *rest.Config) (dynamic.Interface, error) {
+	return dynamic.NewForConfig(config)
+}
@@ -0,0 +1,198 @@
+package preview
+
+import (
+	"context"
+	"fmt"
+
+	networkingv1alpha3api "istio.io/api/networking/v1alpha3"
+	istionetworking "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	PropagationOff  = "off"
+	PropagationLua  = "lua"
+	PropagationWasm = "wasm"
+)
+
+// sharedDataKey is the proxy-wasm "shared data" key the inbound and
+// outbound filters correlate through in wasm mode. Unlike Lua's
+// streamInfo():dynamicMetadata(), which is scoped to the single HTTP
+// stream it was set on, proxy-wasm's get_shared_data/set_shared_data is
+// shared across every filter instance in an Envoy worker — inbound and
+// outbound listener chains included — so it's the one thing here that can
+// actually carry a value from an inbound request to an unrelated outbound
+// one. It's a single slot (last-value-wins), so concurrent in-flight
+// requests on the same pod can race each other; that's an acceptable
+// trade-off for a preview header and not for anything that needs per-
+// request correlation.
+const sharedDataKey = "x-preview"
+
+func envoyFilterName(originSvcName, version string) string {
+	return fmt.Sprintf("%s-envoy-filter", PreviewName(originSvcName, version))
+}
+
+// CreateEnvoyFilter installs the per-preview EnvoyFilter that keeps
+// X-PREVIEW alive past the first hop. It only attaches to the preview's
+// own pods, selected by workloadLabels (the same labels
+// CreateDeploy/CreateMirrorDeploy put on the mirrored Deployment). It is a
+// no-op if the EnvoyFilter already exists.
+//
+// Only propagation=wasm actually re-injects the header on outbound calls:
+// it stashes X-PREVIEW into proxy-wasm shared data on the way in and
+// reads it back out on the way out. propagation=lua only stashes the
+// header into request-scoped dynamic metadata for inbound observability
+// (e.g. access logs) — Lua filter state doesn't cross from the inbound
+// listener's Lua VM to the outbound listener's, so there's nothing for a
+// Lua-side outbound filter to read, and one isn't installed.
+func CreateEnvoyFilter(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version, propagation string, workloadLabels map[string]string, owner metav1.OwnerReference) error {
+	if propagation == "" || propagation == PropagationOff {
+		return nil
+	}
+
+	inboundValue, err := previewHeaderFilterConfig(propagation, stashFilter)
+	if err != nil {
+		return err
+	}
+	patches := []*networkingv1alpha3api.EnvoyFilter_EnvoyConfigObjectPatch{
+		httpFilterPatch(networkingv1alpha3api.EnvoyFilter_SIDECAR_INBOUND, inboundValue),
+	}
+
+	if propagation == PropagationWasm {
+		outboundValue, err := previewHeaderFilterConfig(propagation, reinjectFilter)
+		if err != nil {
+			return err
+		}
+		patches = append(patches, httpFilterPatch(networkingv1alpha3api.EnvoyFilter_SIDECAR_OUTBOUND, outboundValue))
+	}
+
+	ef := &istionetworking.EnvoyFilter{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "EnvoyFilter",
+			APIVersion: "networking.istio.io/v1alpha3",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            envoyFilterName(originSvcName, version),
+			Namespace:       IstioNamespace,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: networkingv1alpha3api.EnvoyFilter{
+			WorkloadSelector: &networkingv1alpha3api.WorkloadSelector{
+				Labels: workloadLabels,
+			},
+			ConfigPatches: patches,
+		},
+	}
+
+	if _, err := ics.NetworkingV1alpha3().EnvoyFilters(IstioNamespace).Create(ctx, ef, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create envoy filter: %w", err)
+	}
+	return nil
+}
+
+func httpFilterPatch(context networkingv1alpha3api.EnvoyFilter_PatchContext, value *structpb.Struct) *networkingv1alpha3api.EnvoyFilter_EnvoyConfigObjectPatch {
+	return &networkingv1alpha3api.EnvoyFilter_EnvoyConfigObjectPatch{
+		ApplyTo: networkingv1alpha3api.EnvoyFilter_HTTP_FILTER,
+		Match: &networkingv1alpha3api.EnvoyFilter_EnvoyConfigObjectMatch{
+			Context: context,
+			ObjectTypes: &networkingv1alpha3api.EnvoyFilter_EnvoyConfigObjectMatch_Listener{
+				Listener: &networkingv1alpha3api.EnvoyFilter_ListenerMatch{
+					FilterChain: &networkingv1alpha3api.EnvoyFilter_ListenerMatch_FilterChainMatch{
+						Filter: &networkingv1alpha3api.EnvoyFilter_ListenerMatch_FilterMatch{
+							Name: "envoy.filters.network.http_connection_manager",
+						},
+					},
+				},
+			},
+		},
+		Patch: &networkingv1alpha3api.EnvoyFilter_Patch{
+			Operation: networkingv1alpha3api.EnvoyFilter_Patch_INSERT_BEFORE,
+			Value:     value,
+		},
+	}
+}
+
+// DeleteEnvoyFilter removes the EnvoyFilter created by CreateEnvoyFilter,
+// and is a no-op if propagation was off (nothing was ever created).
+func DeleteEnvoyFilter(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) error {
+	name := envoyFilterName(originSvcName, version)
+	err := ics.NetworkingV1alpha3().EnvoyFilters(IstioNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// filterRole picks which half of the propagation the patch implements:
+// stashFilter runs on the inbound listener, reinjectFilter on the
+// outbound one.
+type filterRole int
+
+const (
+	stashFilter filterRole = iota
+	reinjectFilter
+)
+
+// previewHeaderFilterConfig builds the typed_config for the HTTP filter
+// that implements one half (stash or reinject) of X-PREVIEW propagation,
+// as either a Lua script or a WASM plugin reference.
+func previewHeaderFilterConfig(propagation string, role filterRole) (*structpb.Struct, error) {
+	if propagation == PropagationWasm {
+		return structpb.NewStruct(map[string]interface{}{
+			"name": "envoy.filters.http.wasm",
+			"typed_config": map[string]interface{}{
+				"@type": "type.googleapis.com/envoy.extensions.filters.http.wasm.v3.Wasm",
+				"config": map[string]interface{}{
+					"name": wasmPluginName(role),
+					"configuration": map[string]interface{}{
+						"@type": "type.googleapis.com/google.protobuf.StringValue",
+						"value": sharedDataKey,
+					},
+					"vm_config": map[string]interface{}{
+						"runtime": "envoy.wasm.runtime.v8",
+						"code": map[string]interface{}{
+							"local": map[string]interface{}{
+								"filename": fmt.Sprintf("/etc/istio/extensions/%s.wasm", wasmPluginName(role)),
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
+	return structpb.NewStruct(map[string]interface{}{
+		"name": "envoy.filters.http.lua",
+		"typed_config": map[string]interface{}{
+			"@type":       "type.googleapis.com/envoy.extensions.filters.http.lua.v3.Lua",
+			"inline_code": previewHeaderLuaStashScript(),
+		},
+	})
+}
+
+func wasmPluginName(role filterRole) string {
+	if role == reinjectFilter {
+		return "preview-header-reinject"
+	}
+	return "preview-header-stash"
+}
+
+// previewHeaderLuaStashScript stashes X-PREVIEW into request-scoped
+// dynamic metadata on the inbound listener, for observability only (e.g.
+// access logs) — Lua has no state that survives past this one stream, so
+// there's no corresponding reinject script; see CreateEnvoyFilter's
+// doc comment.
+func previewHeaderLuaStashScript() string {
+	return `
+function envoy_on_request(handle)
+  local preview = handle:headers():get("` + PreviewHeader + `")
+  if preview then
+    handle:streamInfo():dynamicMetadata():set("preview", "header", preview)
+  end
+end
+`
+}
@@ -0,0 +1,409 @@
+// Package preview holds the object-mirroring logic shared by the `preview`
+// CLI and the preview controller: given an origin Service/Deployment, create,
+// update or remove the preview-version mirrors and Istio routing for it.
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	networkingv1beta1 "istio.io/api/networking/v1beta1"
+	istionetworking "istio.io/client-go/pkg/apis/networking/v1beta1"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	PreviewPrefixName = "pr"
+	AppNamespace      = "default"
+	IstioNamespace    = "istio-system"
+	PreviewHeader     = "X-PREVIEW"
+)
+
+func PreviewName(origin, version string) string {
+	return fmt.Sprintf("%s%s-%s", PreviewPrefixName, version, origin)
+}
+
+func PreviewVirtualServiceName(originSvc string) string {
+	return fmt.Sprintf("%s%s-virtual-service", PreviewPrefixName, originSvc)
+}
+
+func PreviewGatewayVirtualServiceName(originSvc, version string) string {
+	return fmt.Sprintf("%s-gateway-virtual-service", PreviewName(originSvc, version))
+}
+
+type Selector struct {
+	Key   string
+	Value string
+}
+
+// CreateService clones originService's Service with its selector rewritten
+// to the preview version, and returns the selector that was rewritten so
+// CreateDeploy can find the matching Deployment.
+func CreateService(ctx context.Context, cs *kubernetes.Clientset, name, version string, owner metav1.OwnerReference) (*Selector, error) {
+	itf := cs.CoreV1().Services(AppNamespace)
+	svcs, err := itf.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var baseSvc corev1.Service
+	for _, item := range svcs.Items {
+		if item.Name == name {
+			baseSvc = item
+			break
+		}
+	}
+
+	var selector *Selector
+	for k, v := range baseSvc.Spec.Selector {
+		selector = &Selector{Key: k, Value: v}
+	}
+	if selector == nil {
+		return nil, fmt.Errorf("not found selector from service %s", name)
+	}
+
+	newSvc := baseSvc.DeepCopy()
+	newSvc.Name = PreviewName(baseSvc.Name, version)
+	newSvc.ObjectMeta.ResourceVersion = ""
+	newSvc.ObjectMeta.OwnerReferences = []metav1.OwnerReference{owner}
+	newSvc.Labels[selector.Key] = PreviewName(selector.Value, version)
+	newSvc.Spec.Selector[selector.Key] = PreviewName(selector.Value, version)
+
+	if _, err := itf.Create(ctx, newSvc, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+	return selector, nil
+}
+
+// CreateDeploy clones the Deployment matched by selector, rewriting its
+// labels/selector to the preview version and optionally overriding the
+// image and env of its first container.
+func CreateDeploy(ctx context.Context, cs *kubernetes.Clientset, selector *Selector, version, image string, env []corev1.EnvVar, owner metav1.OwnerReference) error {
+	itf := cs.AppsV1().Deployments(AppNamespace)
+	deps, err := itf.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	var baseDeploy appsv1.Deployment
+	for _, item := range deps.Items {
+		val, ok := item.Spec.Selector.MatchLabels[selector.Key]
+		if !ok {
+			continue
+		}
+		if val == selector.Value {
+			baseDeploy = item
+			break
+		}
+	}
+
+	newDeploy := baseDeploy.DeepCopy()
+	newDeploy.Name = PreviewName(baseDeploy.Name, version)
+	newDeploy.ResourceVersion = ""
+	newDeploy.OwnerReferences = []metav1.OwnerReference{owner}
+	newDeploy.Spec.Selector.MatchLabels[selector.Key] = PreviewName(selector.Value, version)
+	if _, ok := newDeploy.Spec.Template.Labels[selector.Key]; ok {
+		newDeploy.Spec.Template.Labels[selector.Key] = PreviewName(selector.Value, version)
+	}
+	applyOverrides(&newDeploy.Spec.Template.Spec, image, env)
+
+	if _, err := itf.Create(ctx, newDeploy, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// UpdateDeploy mutates the mirrored Deployment's image/env in place, used
+// when a Preview CR is edited rather than recreated.
+func UpdateDeploy(ctx context.Context, cs *kubernetes.Clientset, originSvcName, version, image string, env []corev1.EnvVar) error {
+	itf := cs.AppsV1().Deployments(AppNamespace)
+	name := PreviewName(originSvcName, version)
+	dep, err := itf.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	applyOverrides(&dep.Spec.Template.Spec, image, env)
+	_, err = itf.Update(ctx, dep, metav1.UpdateOptions{})
+	return err
+}
+
+func applyOverrides(spec *corev1.PodSpec, image string, env []corev1.EnvVar) {
+	if len(spec.Containers) == 0 {
+		return
+	}
+	if image != "" {
+		spec.Containers[0].Image = image
+	}
+	if env != nil {
+		spec.Containers[0].Env = env
+	}
+}
+
+// DeleteServiceAndDeploy removes the mirrored Service and Deployment for
+// originSvcName/version, ignoring NotFound so delete stays idempotent.
+func DeleteServiceAndDeploy(ctx context.Context, cs *kubernetes.Clientset, originSvcName, version string) error {
+	name := PreviewName(originSvcName, version)
+	if err := cs.CoreV1().Services(AppNamespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := cs.AppsV1().Deployments(AppNamespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// CreateGatewayVirtualService creates the ingress-facing VirtualService for
+// a preview. With legacy set it routes to the cloned preview Service as
+// before; otherwise it routes to the origin host's DestinationRule subset
+// for version, so no Service ever needs to be cloned. It is a no-op if the
+// VirtualService already exists.
+func CreateGatewayVirtualService(ctx context.Context, ics *versionedclient.Clientset, url, gateway, originSvcName, version string, legacy bool, owner metav1.OwnerReference) error {
+	itf := ics.NetworkingV1beta1().VirtualServices(IstioNamespace)
+
+	originHost := fmt.Sprintf("%s.%s.svc.cluster.local", originSvcName, AppNamespace)
+	previewHost := PreviewName(originHost, version)
+	destination := &networkingv1beta1.Destination{Host: originHost}
+	if legacy {
+		destination.Host = previewHost
+	} else {
+		destination.Subset = SubsetName(version)
+	}
+
+	vs := &istionetworking.VirtualService{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "VirtualService",
+			APIVersion: "networking.istio.io/v1beta1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            PreviewGatewayVirtualServiceName(originSvcName, version),
+			Namespace:       IstioNamespace,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: networkingv1beta1.VirtualService{
+			Hosts:    []string{url},
+			Gateways: []string{gateway},
+			Http: []*networkingv1beta1.HTTPRoute{{
+				Name: previewHost,
+				Route: []*networkingv1beta1.HTTPRouteDestination{{
+					Headers: &networkingv1beta1.Headers{
+						Request: &networkingv1beta1.Headers_HeaderOperations{
+							Add: map[string]string{
+								PreviewHeader: PreviewName(originSvcName, version),
+							},
+						},
+					},
+					Destination: destination,
+				}},
+			}},
+		},
+	}
+
+	if _, err := itf.Create(ctx, vs, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create new virtual-service: %w", err)
+	}
+	return nil
+}
+
+func DeleteGatewayVirtualService(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) error {
+	name := PreviewGatewayVirtualServiceName(originSvcName, version)
+	err := ics.NetworkingV1beta1().VirtualServices(IstioNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// defaultDestination is the sidecar VirtualService's fallback route,
+// matched by any request that doesn't carry X-PREVIEW. In subset mode the
+// origin Service's selector still matches every live preview's pods too
+// (CreateMirrorDeploy leaves it untouched), so the fallback must target
+// PrimarySubset explicitly rather than a bare host.
+func defaultDestination(originHost string, legacy bool) *networkingv1beta1.Destination {
+	if legacy {
+		return &networkingv1beta1.Destination{Host: originHost}
+	}
+	return &networkingv1beta1.Destination{Host: originHost, Subset: PrimarySubset}
+}
+
+// CreateSidecarVirtualService splices a preview-only HTTPRoute into the
+// sidecar VirtualService for originSvcName, creating the base route for the
+// origin host first if it doesn't exist yet. With legacy set the route
+// targets the cloned preview Service; otherwise it targets the origin
+// host's DestinationRule subset for version. Calling it again for the same
+// originSvcName/version replaces the existing route in place rather than
+// appending a duplicate.
+func CreateSidecarVirtualService(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string, legacy bool) error {
+	originHost := fmt.Sprintf("%s.%s.svc.cluster.local", originSvcName, AppNamespace)
+	previewHost := PreviewName(originHost, version)
+	destination := &networkingv1beta1.Destination{Host: originHost}
+	if legacy {
+		destination.Host = previewHost
+	} else {
+		destination.Subset = SubsetName(version)
+	}
+
+	vss, err := ics.NetworkingV1beta1().VirtualServices(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	var baseResource *istionetworking.VirtualService
+	for _, i := range vss.Items {
+		// NOTE: ignore `mesh` gateway pattern
+		if len(i.Spec.Gateways) != 0 {
+			continue
+		}
+
+		for _, h := range i.Spec.Hosts {
+			if h == originHost {
+				baseResource = i.DeepCopy()
+			}
+		}
+	}
+
+	itf := ics.NetworkingV1beta1().VirtualServices(IstioNamespace)
+
+	// origin host用sidecar virtual serviceの新規作成
+	if baseResource == nil {
+		base := &istionetworking.VirtualService{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "VirtualService",
+				APIVersion: "networking.istio.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      PreviewVirtualServiceName(originSvcName),
+				Namespace: IstioNamespace,
+			},
+			Spec: networkingv1beta1.VirtualService{
+				Hosts: []string{originHost},
+				Http: []*networkingv1beta1.HTTPRoute{{
+					Name: originHost,
+					Route: []*networkingv1beta1.HTTPRouteDestination{{
+						Destination: defaultDestination(originHost, legacy),
+					}},
+				}},
+			},
+		}
+		ret, err := itf.Create(ctx, base, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		baseResource = ret
+	}
+
+	route := &networkingv1beta1.HTTPRoute{
+		Name: previewHost,
+		Match: []*networkingv1beta1.HTTPMatchRequest{{
+			Headers: map[string]*networkingv1beta1.StringMatch{
+				PreviewHeader: {
+					MatchType: &networkingv1beta1.StringMatch_Prefix{
+						Prefix: PreviewName("", version),
+					},
+				},
+			},
+		}},
+		Route: []*networkingv1beta1.HTTPRouteDestination{{
+			Destination: destination,
+		}},
+	}
+	replaced := false
+	for i, r := range baseResource.Spec.Http {
+		if r.Name == previewHost {
+			baseResource.Spec.Http[i] = route
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		baseResource.Spec.Http = append(baseResource.Spec.Http, route)
+	}
+	baseResource.ManagedFields = []metav1.ManagedFieldsEntry{}
+	baseResource.TypeMeta = metav1.TypeMeta{
+		Kind:       "VirtualService",
+		APIVersion: "networking.istio.io/v1beta1",
+	}
+
+	sortPreviewRoutesFirst(baseResource)
+
+	return applyVirtualService(ctx, itf, baseResource)
+}
+
+// DeleteSidecarVirtualServiceRoute removes the single HTTPRoute for
+// originSvcName/version from the sidecar VirtualService, preserving the
+// tail-sort invariant, and removes the whole VirtualService if nothing but
+// the default origin route is left.
+func DeleteSidecarVirtualServiceRoute(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) error {
+	vs, empty, exists, err := PlanSidecarVirtualServiceWithoutRoute(ctx, ics, originSvcName, version)
+	if err != nil || !exists {
+		return err
+	}
+
+	itf := ics.NetworkingV1beta1().VirtualServices(IstioNamespace)
+	if empty {
+		return itf.Delete(ctx, vs.Name, metav1.DeleteOptions{})
+	}
+	return applyVirtualService(ctx, itf, vs)
+}
+
+// PlanSidecarVirtualServiceWithoutRoute computes the sidecar VirtualService
+// that would result from removing originSvcName/version's route, without
+// applying it, so callers (e.g. `preview delete --dry-run`) can show it.
+// exists is false if the sidecar VirtualService doesn't exist.
+func PlanSidecarVirtualServiceWithoutRoute(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) (vs *istionetworking.VirtualService, empty, exists bool, err error) {
+	originHost := fmt.Sprintf("%s.%s.svc.cluster.local", originSvcName, AppNamespace)
+	previewHost := PreviewName(originHost, version)
+
+	vsName := PreviewVirtualServiceName(originSvcName)
+	vs, err = ics.NetworkingV1beta1().VirtualServices(IstioNamespace).Get(ctx, vsName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, false, false, nil
+		}
+		return nil, false, false, err
+	}
+
+	routes := make([]*networkingv1beta1.HTTPRoute, 0, len(vs.Spec.Http))
+	for _, r := range vs.Spec.Http {
+		if r.Name == previewHost {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	vs.Spec.Http = routes
+	sortPreviewRoutesFirst(vs)
+
+	return vs, len(vs.Spec.Http) <= 1, true, nil
+}
+
+// 通常サービスへのルーティングを末尾に移動させる
+func sortPreviewRoutesFirst(vs *istionetworking.VirtualService) {
+	sort.Slice(vs.Spec.Http, func(i, _ int) bool {
+		return strings.HasPrefix(vs.Spec.Http[i].Name, PreviewPrefixName)
+	})
+}
+
+func applyVirtualService(ctx context.Context, itf interface {
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*istionetworking.VirtualService, error)
+}, vs *istionetworking.VirtualService) error {
+	bytes, err := json.Marshal(vs)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	opts := metav1.PatchOptions{
+		FieldManager: "preview",
+		Force:        &force,
+	}
+	_, err = itf.Patch(ctx, vs.Name, types.ApplyPatchType, bytes, opts)
+	return err
+}
@@ -0,0 +1,202 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	networkingv1beta1 "istio.io/api/networking/v1beta1"
+	istionetworking "istio.io/client-go/pkg/apis/networking/v1beta1"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SubsetLabelKey is the pod-template label a DestinationRule subset
+// selects on, so a preview version can be routed to without forking the
+// origin Service in two.
+const SubsetLabelKey = "version"
+
+// PrimarySubset selects the origin's own pods, via an explicit
+// version=primary label that CreateMirrorDeploy's preview pods never
+// carry. The origin Service's selector is left untouched by subset
+// routing, so it balances across origin and every live preview's pods
+// alike; any route that should fall back to origin rather than join that
+// mix must target this subset explicitly instead of a bare host.
+const PrimarySubset = "primary"
+
+func SubsetName(version string) string {
+	return fmt.Sprintf("%s%s", PreviewPrefixName, version)
+}
+
+// EnsureOriginPrimaryLabel labels the origin Deployment's pod template
+// version=primary if it isn't already, so PrimarySubset only matches
+// origin pods. It only touches the pod template, never Spec.Selector,
+// which is immutable once the Deployment exists.
+func EnsureOriginPrimaryLabel(ctx context.Context, cs *kubernetes.Clientset, originSvcName string) error {
+	itf := cs.AppsV1().Deployments(AppNamespace)
+	dep, err := itf.Get(ctx, originSvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if dep.Spec.Template.Labels[SubsetLabelKey] == PrimarySubset {
+		return nil
+	}
+	if dep.Spec.Template.Labels == nil {
+		dep.Spec.Template.Labels = map[string]string{}
+	}
+	dep.Spec.Template.Labels[SubsetLabelKey] = PrimarySubset
+	_, err = itf.Update(ctx, dep, metav1.UpdateOptions{})
+	return err
+}
+
+func destinationRuleName(originSvcName string) string {
+	return fmt.Sprintf("%s-destination-rule", originSvcName)
+}
+
+// CreateMirrorDeploy clones the origin Deployment (fetched by name, the
+// same as originSvcName), but leaves the origin Service's selector
+// untouched: the clone only gains the subset label, so the existing
+// Service keeps selecting both the origin and every preview version's
+// pods. It is a no-op if the mirrored Deployment already exists.
+func CreateMirrorDeploy(ctx context.Context, cs *kubernetes.Clientset, originSvcName string, version, image string, env []corev1.EnvVar, owner metav1.OwnerReference) error {
+	itf := cs.AppsV1().Deployments(AppNamespace)
+	baseDeploy, err := itf.Get(ctx, originSvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	newDeploy := baseDeploy.DeepCopy()
+	newDeploy.Name = PreviewName(baseDeploy.Name, version)
+	newDeploy.ResourceVersion = ""
+	newDeploy.OwnerReferences = []metav1.OwnerReference{owner}
+	if newDeploy.Spec.Template.Labels == nil {
+		newDeploy.Spec.Template.Labels = map[string]string{}
+	}
+	newDeploy.Spec.Template.Labels[SubsetLabelKey] = SubsetName(version)
+	if newDeploy.Spec.Selector.MatchLabels == nil {
+		newDeploy.Spec.Selector.MatchLabels = map[string]string{}
+	}
+	newDeploy.Spec.Selector.MatchLabels[SubsetLabelKey] = SubsetName(version)
+	applyOverrides(&newDeploy.Spec.Template.Spec, image, env)
+
+	if _, err := itf.Create(ctx, newDeploy, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// ReconcileDestinationRule adds a subset for version to the single
+// DestinationRule for originSvcName, creating the DestinationRule on its
+// first preview if necessary.
+func ReconcileDestinationRule(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) error {
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", originSvcName, AppNamespace)
+	name := destinationRuleName(originSvcName)
+	itf := ics.NetworkingV1beta1().DestinationRules(IstioNamespace)
+
+	dr, err := itf.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		dr = &istionetworking.DestinationRule{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "DestinationRule",
+				APIVersion: "networking.istio.io/v1beta1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: IstioNamespace,
+			},
+			Spec: networkingv1beta1.DestinationRule{
+				Host: host,
+			},
+		}
+	} else if err != nil {
+		return err
+	}
+
+	changed := addSubset(dr, PrimarySubset, map[string]string{SubsetLabelKey: PrimarySubset})
+	subset := SubsetName(version)
+	if addSubset(dr, subset, map[string]string{SubsetLabelKey: subset}) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	return applyDestinationRule(ctx, itf, dr)
+}
+
+// addSubset appends a subset to dr if one by that name doesn't already
+// exist, reporting whether it made a change.
+func addSubset(dr *istionetworking.DestinationRule, name string, labels map[string]string) bool {
+	for _, s := range dr.Spec.Subsets {
+		if s.Name == name {
+			return false
+		}
+	}
+	dr.Spec.Subsets = append(dr.Spec.Subsets, &networkingv1beta1.Subset{Name: name, Labels: labels})
+	return true
+}
+
+// DeleteDestinationRuleSubset removes version's subset from the
+// DestinationRule for originSvcName, deleting the DestinationRule itself
+// once no subsets are left. It is a no-op if the DestinationRule was never
+// created (e.g. --legacy-service-clone previews).
+func DeleteDestinationRuleSubset(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) error {
+	dr, empty, exists, err := PlanDestinationRuleWithoutSubset(ctx, ics, originSvcName, version)
+	if err != nil || !exists {
+		return err
+	}
+
+	itf := ics.NetworkingV1beta1().DestinationRules(IstioNamespace)
+	if empty {
+		return itf.Delete(ctx, dr.Name, metav1.DeleteOptions{})
+	}
+	return applyDestinationRule(ctx, itf, dr)
+}
+
+// PlanDestinationRuleWithoutSubset computes the DestinationRule that would
+// result from removing originSvcName/version's subset, without applying it,
+// so callers (e.g. `preview delete --dry-run`) can show it. exists is false
+// if the DestinationRule was never created.
+func PlanDestinationRuleWithoutSubset(ctx context.Context, ics *versionedclient.Clientset, originSvcName, version string) (dr *istionetworking.DestinationRule, empty, exists bool, err error) {
+	name := destinationRuleName(originSvcName)
+	dr, err = ics.NetworkingV1beta1().DestinationRules(IstioNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, false, false, nil
+		}
+		return nil, false, false, err
+	}
+
+	subset := SubsetName(version)
+	subsets := make([]*networkingv1beta1.Subset, 0, len(dr.Spec.Subsets))
+	for _, s := range dr.Spec.Subsets {
+		if s.Name == subset {
+			continue
+		}
+		subsets = append(subsets, s)
+	}
+	dr.Spec.Subsets = subsets
+
+	return dr, len(dr.Spec.Subsets) == 0, true, nil
+}
+
+func applyDestinationRule(ctx context.Context, itf interface {
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*istionetworking.DestinationRule, error)
+}, dr *istionetworking.DestinationRule) error {
+	bytes, err := json.Marshal(dr)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	opts := metav1.PatchOptions{
+		FieldManager: "preview",
+		Force:        &force,
+	}
+	_, err = itf.Patch(ctx, dr.Name, types.ApplyPatchType, bytes, opts)
+	return err
+}